@@ -0,0 +1,315 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramSample carries everything needed to re-emit a parsed classic
+// histogram. Native (sparse exponential) histograms aren't supported: the
+// only wire format this exporter speaks is expfmt's text parser, and
+// neither Prometheus text exposition nor OpenMetrics text carries the
+// span/delta fields native histograms need — those only exist in the
+// protobuf exposition format, which textfiles never use.
+type histogramSample struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// summarySample carries a parsed summary's quantiles plus its _sum/_count.
+type summarySample struct {
+	count     uint64
+	sum       float64
+	quantiles map[float64]float64
+}
+
+// metricEntry is one data point kept alive in the collector, tagged with the
+// timestamp it was scraped with so that stale entries can be evicted and so
+// that /metrics can keep reporting the original file timestamp.
+type metricEntry struct {
+	name      string
+	help      string
+	labels    map[string]string
+	timestamp time.Time
+	maxAge    time.Duration
+
+	simpleType  prometheus.ValueType
+	simpleValue float64
+
+	histogram *histogramSample
+	summary   *summarySample
+}
+
+// fileStatus is the per-file bookkeeping behind textfile_exporter_mtime_seconds
+// and textfile_exporter_file_scrape_error.
+type fileStatus struct {
+	mtime  time.Time
+	failed bool
+}
+
+// snapshot is an immutable view of everything Collect needs to emit. A scan
+// builds one from scratch and, once complete, publishes it atomically so a
+// concurrent scrape either sees the previous snapshot in full or the new
+// one in full, never something in between.
+type snapshot struct {
+	entries          map[string]*metricEntry
+	fileStatuses     map[string]*fileStatus
+	scanInconsistent bool
+}
+
+// timeAwareCollector is a prometheus.Collector whose metrics are filled in
+// from parsed textfiles rather than live instrumentation. Entries older
+// than their max age (or the collector-wide default) are dropped when a
+// scan carries the previous snapshot forward, so metrics from files which
+// stopped being updated eventually disappear instead of being reported
+// forever.
+//
+// Exactly one goroutine (the scan loop in main) is expected to call
+// BeginScan/Add*/EndScan; Collect only ever reads the published snapshot,
+// so no locking is needed on the hot scrape path.
+type timeAwareCollector struct {
+	maxAge  time.Duration
+	current atomic.Pointer[snapshot]
+
+	// building is only touched by the scanning goroutine, between a
+	// BeginScan and the matching EndScan.
+	building *snapshot
+
+	mtimeDesc       *prometheus.Desc
+	fileErrorDesc   *prometheus.Desc
+	scrapeErrorDesc *prometheus.Desc
+}
+
+func newTimeAwareCollector(maxAge time.Duration) *timeAwareCollector {
+	return &timeAwareCollector{
+		maxAge: maxAge,
+		mtimeDesc: prometheus.NewDesc(
+			"textfile_exporter_mtime_seconds",
+			"Modification time of a scanned textfile, in seconds since the Unix epoch.",
+			[]string{"file"}, nil,
+		),
+		fileErrorDesc: prometheus.NewDesc(
+			"textfile_exporter_file_scrape_error",
+			"1 if there was an error parsing this textfile during the last scan, 0 otherwise.",
+			[]string{"file"}, nil,
+		),
+		scrapeErrorDesc: prometheus.NewDesc(
+			"textfile_exporter_scrape_error",
+			// Deliberately not split by file (see textfile_exporter_file_scrape_error
+			// for that): mirrors node_exporter's textfile collector, whose
+			// node_textfile_scrape_error is a single global signal to alert on.
+			"1 if any textfile failed to parse, or HELP/TYPE was inconsistent across files, during the last scan.",
+			nil, nil,
+		),
+	}
+}
+
+// BeginScan starts building the next snapshot. The snapshot currently
+// published to Collect is untouched and keeps being served until EndScan
+// swaps the new one in, so a scrape never observes a partially-populated
+// scan.
+func (c *timeAwareCollector) BeginScan() {
+	c.building = &snapshot{
+		entries:      make(map[string]*metricEntry),
+		fileStatuses: make(map[string]*fileStatus),
+	}
+}
+
+// EndScan carries forward still-fresh entries and file statuses from the
+// previous snapshot that this scan didn't re-see, then atomically publishes
+// the merged snapshot for Collect to use. Anything past its max age is
+// dropped instead of carried forward, so files that rotate, get deleted, or
+// stop matching -p eventually disappear from /metrics rather than reporting
+// a stale status forever.
+func (c *timeAwareCollector) EndScan() {
+	now := time.Now()
+	if prev := c.current.Load(); prev != nil {
+		for key, e := range prev.entries {
+			if _, reseen := c.building.entries[key]; reseen {
+				continue
+			}
+			maxAge := e.maxAge
+			if maxAge <= 0 {
+				maxAge = c.maxAge
+			}
+			if maxAge > 0 && now.Sub(e.timestamp) > maxAge {
+				continue // Evicted: not re-seen and past its max age.
+			}
+			c.building.entries[key] = e
+		}
+		for file, s := range prev.fileStatuses {
+			if _, reseen := c.building.fileStatuses[file]; reseen {
+				continue
+			}
+			if c.maxAge > 0 && now.Sub(s.mtime) > c.maxAge {
+				continue // Evicted: file no longer seen and past its max age.
+			}
+			c.building.fileStatuses[file] = s
+		}
+	}
+	c.current.Store(c.building)
+	c.building = nil
+}
+
+// SetFileStatus records the mtime and parse outcome of one scanned file.
+func (c *timeAwareCollector) SetFileStatus(file string, mtime time.Time, failed bool) {
+	c.building.fileStatuses[file] = &fileStatus{mtime: mtime, failed: failed}
+}
+
+// SetScanInconsistent flags the current scan as having seen different
+// HELP/TYPE metadata for the same metric name across different files.
+func (c *timeAwareCollector) SetScanInconsistent(inconsistent bool) {
+	c.building.scanInconsistent = inconsistent
+}
+
+// entryKey identifies a unique series: its metric name plus its sorted
+// label set.
+func entryKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte('\x00')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// Add registers a gauge, counter, or untyped sample. A ttl of 0 means "use
+// the collector-wide max age".
+func (c *timeAwareCollector) Add(name string, labels map[string]string, valueType prometheus.ValueType, value float64, timestamp time.Time, ttl time.Duration, help string) {
+	c.building.entries[entryKey(name, labels)] = &metricEntry{
+		name:        name,
+		help:        help,
+		labels:      labels,
+		timestamp:   timestamp,
+		maxAge:      ttl,
+		simpleType:  valueType,
+		simpleValue: value,
+	}
+}
+
+// AddHistogram registers a classic histogram sample.
+func (c *timeAwareCollector) AddHistogram(name string, labels map[string]string, sample *histogramSample, timestamp time.Time, ttl time.Duration, help string) {
+	c.building.entries[entryKey(name, labels)] = &metricEntry{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		timestamp: timestamp,
+		maxAge:    ttl,
+		histogram: sample,
+	}
+}
+
+// AddSummary registers a summary sample.
+func (c *timeAwareCollector) AddSummary(name string, labels map[string]string, sample *summarySample, timestamp time.Time, ttl time.Duration, help string) {
+	c.building.entries[entryKey(name, labels)] = &metricEntry{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		timestamp: timestamp,
+		maxAge:    ttl,
+		summary:   sample,
+	}
+}
+
+// Describe sends the fixed file-status descriptors. The per-file metric
+// entries collected from textfiles are not described here since their
+// names and label sets are only known once the watched files have been
+// parsed, making this a partially unchecked collector.
+func (c *timeAwareCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.mtimeDesc
+	ch <- c.fileErrorDesc
+	ch <- c.scrapeErrorDesc
+}
+
+func (c *timeAwareCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.current.Load()
+	if snap == nil {
+		ch <- prometheus.MustNewConstMetric(c.scrapeErrorDesc, prometheus.GaugeValue, 0)
+		return
+	}
+
+	scrapeError := snap.scanInconsistent
+	for file, status := range snap.fileStatuses {
+		ch <- prometheus.MustNewConstMetric(c.mtimeDesc, prometheus.GaugeValue, float64(status.mtime.Unix()), file)
+		fileErr := 0.0
+		if status.failed {
+			fileErr = 1.0
+			scrapeError = true
+		}
+		ch <- prometheus.MustNewConstMetric(c.fileErrorDesc, prometheus.GaugeValue, fileErr, file)
+	}
+	globalErr := 0.0
+	if scrapeError {
+		globalErr = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeErrorDesc, prometheus.GaugeValue, globalErr)
+
+	// Eviction of stale entries already happened when the snapshot was
+	// published in EndScan, so every entry here is fair game to emit.
+	for _, e := range snap.entries {
+		labelNames := make([]string, 0, len(e.labels))
+		labelValues := make([]string, 0, len(e.labels))
+		for k, v := range e.labels {
+			labelNames = append(labelNames, k)
+			labelValues = append(labelValues, v)
+		}
+		desc := prometheus.NewDesc(e.name, e.help, labelNames, nil)
+
+		var m prometheus.Metric
+		switch {
+		case e.histogram != nil:
+			m = prometheus.MustNewConstHistogram(desc, e.histogram.count, e.histogram.sum, e.histogram.buckets, labelValues...)
+		case e.summary != nil:
+			m = prometheus.MustNewConstSummary(desc, e.summary.count, e.summary.sum, e.summary.quantiles, labelValues...)
+		default:
+			m = prometheus.MustNewConstMetric(desc, e.simpleType, e.simpleValue, labelValues...)
+		}
+
+		ch <- prometheus.NewMetricWithTimestamp(e.timestamp, m)
+	}
+}
+
+// histogramSampleFromProto converts a parsed dto.Histogram into the form
+// the collector stores. Only the classic buckets are read; see
+// histogramSample for why native histograms aren't supported.
+func histogramSampleFromProto(h *dto.Histogram) *histogramSample {
+	buckets := make(map[float64]uint64, len(h.GetBucket()))
+	for _, b := range h.GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+
+	return &histogramSample{
+		count:   h.GetSampleCount(),
+		sum:     h.GetSampleSum(),
+		buckets: buckets,
+	}
+}
+
+// summarySampleFromProto converts a parsed dto.Summary into the form the
+// collector stores.
+func summarySampleFromProto(s *dto.Summary) *summarySample {
+	quantiles := make(map[float64]float64, len(s.GetQuantile()))
+	for _, q := range s.GetQuantile() {
+		quantiles[q.GetQuantile()] = q.GetValue()
+	}
+	return &summarySample{
+		count:     s.GetSampleCount(),
+		sum:       s.GetSampleSum(),
+		quantiles: quantiles,
+	}
+}
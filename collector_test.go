@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherNames returns the set of metric family names Collect currently
+// reports at least one series for.
+func gatherNames(t *testing.T, c *timeAwareCollector) map[string]bool {
+	t.Helper()
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		if len(mf.GetMetric()) > 0 {
+			names[mf.GetName()] = true
+		}
+	}
+	return names
+}
+
+// TestEndScanCarriesForwardUntilMaxAge covers the carry-forward/eviction
+// contract EndScan is responsible for: an entry not re-seen this scan
+// survives while it's within its max age, and is dropped once it isn't.
+func TestEndScanCarriesForwardUntilMaxAge(t *testing.T) {
+	maxAge := time.Hour
+	c := newTimeAwareCollector(maxAge)
+	now := time.Now()
+
+	c.BeginScan()
+	c.Add("fresh", nil, prometheus.GaugeValue, 1, now, 0, "a fresh gauge")
+	c.Add("stale", nil, prometheus.GaugeValue, 1, now.Add(-2*maxAge), 0, "a stale gauge")
+	c.EndScan()
+
+	if got := gatherNames(t, c); !got["fresh"] || !got["stale"] {
+		t.Fatalf("first scan: got %v, want both fresh and stale present", got)
+	}
+
+	// Second scan re-sees neither series. "fresh" is still within maxAge
+	// of its timestamp and should be carried forward; "stale" is past it
+	// and should be evicted.
+	c.BeginScan()
+	c.EndScan()
+
+	got := gatherNames(t, c)
+	if !got["fresh"] {
+		t.Errorf("second scan: fresh entry was evicted, want it carried forward")
+	}
+	if got["stale"] {
+		t.Errorf("second scan: stale entry was carried forward, want it evicted")
+	}
+}
+
+// TestCollectNeverObservesPartialSnapshot runs scans concurrently with
+// scrapes and asserts Collect only ever reports a fully-populated snapshot
+// (zero series, for a scrape that races ahead of the first EndScan, or
+// every series from one complete scan) and never a snapshot caught
+// mid-build.
+func TestCollectNeverObservesPartialSnapshot(t *testing.T) {
+	c := newTimeAwareCollector(time.Hour)
+	const seriesPerScan = 20
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			c.BeginScan()
+			for j := 0; j < seriesPerScan; j++ {
+				c.Add("m", map[string]string{"i": strconv.Itoa(j)}, prometheus.GaugeValue, float64(j), time.Now(), 0, "help")
+			}
+			c.EndScan()
+		}
+	}()
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		mfs, err := r.Gather()
+		if err != nil {
+			t.Fatalf("Gather() error: %v", err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "m" {
+				continue
+			}
+			if n := len(mf.GetMetric()); n != 0 && n != seriesPerScan {
+				t.Fatalf("Collect observed a partial snapshot: %d of %d series for %q", n, seriesPerScan, "m")
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// levelCycle is the order SIGHUP steps through: quieter each time, then
+// back around to debug.
+var levelCycle = []string{"debug", "info", "warn", "error"}
+
+// logState is the process-wide, runtime-adjustable logger. It replaces the
+// old filesystem-based "touch debug_tfe" toggle: the level can be raised or
+// lowered with a SIGHUP or a request to /debug/level, no restart needed.
+type logState struct {
+	base   log.Logger
+	logger atomic.Value // log.Logger
+	level  atomic.Value // string
+}
+
+// newLogState builds the base logger for -log.format and sets its level to
+// -log.level.
+func newLogState(format, lvl string) (*logState, error) {
+	var base log.Logger
+	switch format {
+	case "logfmt":
+		base = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	case "json":
+		base = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+	default:
+		return nil, fmt.Errorf("unknown -log.format %q (want logfmt or json)", format)
+	}
+	base = log.With(base, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+
+	ls := &logState{base: base}
+	if err := ls.SetLevel(lvl); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// L returns the current filtered logger. Safe for concurrent use.
+func (ls *logState) L() log.Logger {
+	return ls.logger.Load().(log.Logger)
+}
+
+// SetLevel swaps in a logger filtered to lvl (debug, info, warn, or error).
+func (ls *logState) SetLevel(lvl string) error {
+	var opt level.Option
+	switch lvl {
+	case "debug":
+		opt = level.AllowDebug()
+	case "info":
+		opt = level.AllowInfo()
+	case "warn":
+		opt = level.AllowWarn()
+	case "error":
+		opt = level.AllowError()
+	default:
+		return fmt.Errorf("unknown log level %q (want debug, info, warn, or error)", lvl)
+	}
+	ls.logger.Store(level.NewFilter(ls.base, opt))
+	ls.level.Store(lvl)
+	return nil
+}
+
+func (ls *logState) nextLevel() string {
+	current := ls.level.Load().(string)
+	for i, name := range levelCycle {
+		if name == current {
+			return levelCycle[(i+1)%len(levelCycle)]
+		}
+	}
+	return levelCycle[0]
+}
+
+// WatchSIGHUP steps the log level to the next one in levelCycle every time
+// the process receives a SIGHUP.
+func (ls *logState) WatchSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			next := ls.nextLevel()
+			_ = ls.SetLevel(next)
+			level.Info(ls.L()).Log("msg", "log level changed via SIGHUP", "level", next)
+		}
+	}()
+}
+
+// ServeDebugLevel reports the current log level on GET, and sets it on
+// POST/PUT via a "level" query parameter, e.g.
+// curl -X POST 'http://localhost:9014/debug/level?level=debug'.
+func (ls *logState) ServeDebugLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		lvl := r.URL.Query().Get("level")
+		if err := ls.SetLevel(lvl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(ls.L()).Log("msg", "log level changed via /debug/level", "level", lvl)
+	}
+	fmt.Fprintf(w, "%s\n", ls.level.Load().(string))
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -12,22 +11,41 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
     "github.com/prometheus/common/model"
 
 )
 
-func fatal(err error) {
+func fatal(logger log.Logger, err error) {
 	if err != nil {
-		log.Fatalln(err)
+		level.Error(logger).Log("err", err)
+		os.Exit(1)
 	}
 }
 
-// This is going to parse the file at the passed path.
-func parseMF(path string) (map[string]*dto.MetricFamily, error) {
+// isOpenMetricsFile tells apart files written in the OpenMetrics exposition
+// format from plain Prometheus text format files. We go off the `.om`
+// extension first (the convention used by client libraries that write
+// OpenMetrics textfiles), then fall back to sniffing the whole content for
+// a line starting with `# EOF`, the trailer OpenMetrics requires. A `# EOF`
+// on the very first line of the content is not detected.
+func isOpenMetricsFile(path string, head []byte) bool {
+	if strings.HasSuffix(path, ".om") {
+		return true
+	}
+	return strings.Contains(string(head), "\n# EOF")
+}
+
+// This is going to parse the file at the passed path. The returned bool
+// reports whether the file was recognised as OpenMetrics rather than plain
+// Prometheus text format, for callers that want to log it.
+func parseMF(path string) (map[string]*dto.MetricFamily, bool, error) {
 
 	// Standard (overkill?) path sanification.
 	path = filepath.Clean(path)
@@ -38,216 +56,389 @@ func parseMF(path string) (map[string]*dto.MetricFamily, error) {
 	path = filepath.Clean(path)
 
 	// We open the path.
-	reader, err := os.Open(path)
+	raw, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	openMetrics := isOpenMetricsFile(path, raw)
 
-	// We parse the content to return the metrics family result.
+	// OpenMetrics is a superset of the Prometheus text format for the
+	// parts we care about (families and samples), so the same parser
+	// handles both; the `# EOF` trailer OpenMetrics requires is just a
+	// comment line as far as expfmt's text parser is concerned.
 	parser := expfmt.NewTextParser(model.UTF8Validation)
-	mf, err := parser.TextToMetricFamilies(reader)
+	mf, err := parser.TextToMetricFamilies(strings.NewReader(string(raw)))
 	if err != nil {
-		return nil, err
+		return nil, openMetrics, err
 	}
-	return mf, nil
+	return mf, openMetrics, nil
 }
 
-func isOlderThanTwoHours(t time.Time) bool {
-	return time.Now().Sub(t) > 2*time.Hour
+// metaInfo is the HELP/TYPE pair a scan tick has seen for a given metric
+// name so far, used to detect files that disagree about either.
+type metaInfo struct {
+	help string
+	typ  dto.MetricType
 }
 
-// Main function here.
-func main() {
-
-	// Handle passed or default options.
-	optListenPort := flag.Int("l", 9014, "listen port")
-	optPromPath := flag.String("p", ".", "path for prom file or dir of *.prom files")
-	optScanInterval := flag.Duration("i", 30*time.Second, "scan interval")
-	optMemoryMaxAge := flag.Duration("m", 25*time.Hour, "max age of in memory metrics")
-	optOldFilesAge := flag.Duration("o", 6*time.Hour, "min age of files considered old")
-	optOldFilesExternalCmd := flag.String("x", "ls -l {}", "external command executed on old files")
+// isWatchedFile reports whether a scanned file should be parsed, based on
+// its name.
+func isWatchedFile(name string) bool {
+	return strings.HasSuffix(name, ".prom") || strings.HasSuffix(name, ".om")
+}
 
+// addFile appends path's absolute form to *files if it looks like a
+// textfile we watch and hasn't already been added (multiple patterns can
+// resolve to the same file).
+func addFile(path string, files *[]string, seen map[string]bool) {
+	if !isWatchedFile(filepath.Base(path)) {
+		return
+	}
+	addFileUnfiltered(path, files, seen)
+}
 
-	flag.Usage = func() {
-		flag.PrintDefaults()
+// addFileUnfiltered appends path's absolute form to *files regardless of
+// its extension, as long as it hasn't already been added. Used for a
+// directly-named -p entry, which (like the baseline behavior this
+// preserves) is scanned no matter what it's called.
+func addFileUnfiltered(path string, files *[]string, seen map[string]bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if seen[abs] {
+		return
 	}
+	seen[abs] = true
+	*files = append(*files, abs)
+}
 
-	flag.Parse()
+// hasMeta reports whether pattern contains glob metacharacters, i.e.
+// whether it's a pattern rather than a literal, directly-named path.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
 
-	// Create our collector.
-	collector := newTimeAwareCollector(*optMemoryMaxAge)
+// addDirFiles appends the watched files directly under dir, or under the
+// whole subtree when recursive is set.
+func addDirFiles(logger log.Logger, dir string, recursive bool, files *[]string, seen map[string]bool) {
+	if recursive {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			addFile(path, files, seen)
+			return nil
+		})
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		level.Warn(logger).Log("msg", "error reading dir", "dir", dir, "err", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue // We do not do recursion unless -r was passed.
+		}
+		addFile(filepath.Join(dir, entry.Name()), files, seen)
+	}
+}
 
-	// Start a background job to constantly watch for files and parse them.
-	go func() {
-		log.Printf("Textfile Exporter started\n")
-		for { // for ever
-			filepath := *optPromPath
-			fileinfo, err := os.Stat(filepath)
+// expandPatterns turns a comma-separated list of glob patterns, plain dirs,
+// and plain files into the deduplicated, absolute list of textfiles to
+// parse this scan tick.
+func expandPatterns(logger log.Logger, patterns string, recursive bool) []string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			level.Warn(logger).Log("msg", "error expanding pattern", "pattern", pattern, "err", err)
+			continue
+		}
+		for _, match := range matches {
+			fi, err := os.Stat(match)
 			if err != nil {
-				break
+				continue
 			}
-			var debugging bool
-
-			// We have a simple runtime-switchable debug option.
-			// If this file exists and is not older then two hours, debug
-			// output is enabled.
-			if fs, err := os.Stat(filepath + "/debug_tfe"); err == nil {
-				if !isOlderThanTwoHours(fs.ModTime()) {
-					debugging = true
-				} else {
-					debugging = false
-				}
+			if fi.IsDir() {
+				addDirFiles(logger, match, recursive, &files, seen)
+				continue
+			}
+			if hasMeta(pattern) {
+				addFile(match, &files, seen)
 			} else {
-				debugging = false
+				// A directly-named file: scanned regardless of
+				// extension, matching the pre-chunk0-3 behavior.
+				addFileUnfiltered(match, &files, seen)
 			}
-			if debugging {
-				log.Printf("*** DEBUG MODE ENABLED ***\n")
+		}
+	}
+	return files
+}
+
+// newPusher builds a Pushgateway client off the -push* flags, or returns a
+// nil *push.Pusher (and no error) when -push wasn't set, meaning the scan
+// loop should skip pushing entirely.
+func newPusher(logger log.Logger, url, job, grouping, format string, gatherer prometheus.Gatherer) (*push.Pusher, error) {
+	if url == "" {
+		return nil, nil
+	}
+	f, err := parsePushFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	pusher := push.New(url, job).Gatherer(gatherer).Format(f)
+	for name, value := range parsePushGrouping(logger, grouping) {
+		pusher = pusher.Grouping(name, value)
+	}
+	return pusher, nil
+}
+
+// parsePushGrouping turns a "key1=val1,key2=val2" -push-grouping value into
+// a map of grouping labels.
+func parsePushGrouping(logger log.Logger, grouping string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(grouping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			level.Warn(logger).Log("msg", "ignoring malformed -push-grouping entry", "entry", pair)
+			continue
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
+}
+
+// parsePushFormat maps the -push-format flag to the expfmt wire format the
+// Pushgateway client should use.
+func parsePushFormat(format string) (expfmt.Format, error) {
+	switch format {
+	case "text":
+		return expfmt.FmtText, nil
+	case "protobuf":
+		return expfmt.FmtProtoDelim, nil
+	case "openmetrics":
+		return expfmt.FmtOpenMetrics_1_0_0, nil
+	default:
+		return "", fmt.Errorf("unknown -push-format %q (want text, protobuf, or openmetrics)", format)
+	}
+}
+
+// runScan does a single scan-parse-publish(-push) tick: it expands patterns
+// into the files to watch, parses each one into the collector, and pushes
+// the result if a pusher was configured. It's shared by the daemon's scan
+// loop and by -once, which runs it exactly once and exits.
+func runScan(logger log.Logger, collector *timeAwareCollector, self *selfMetrics, pusher *push.Pusher, patterns string, recursive bool, oldFilesAge time.Duration, oldFilesExternalCmd string) {
+	scanStart := time.Now()
+
+	// Let's collect the list of files to process: each comma-separated
+	// entry in -p is expanded as a glob pattern, with plain dirs and
+	// plain files degrading to themselves.
+	files := expandPatterns(logger, patterns, recursive)
+	n := len(files)
+	level.Debug(logger).Log("msg", "found files", "count", n)
+
+	// Start building the next snapshot. A scrape happening mid-scan
+	// keeps being served the previous, fully-populated snapshot
+	// until EndScan publishes this one.
+	collector.BeginScan()
+
+	// Tracks HELP/TYPE seen for a given metric name across every
+	// file in this scan tick, to flag files that disagree.
+	metaSeen := make(map[string]metaInfo)
+	inconsistentMeta := false
+
+	// Parse the files.
+	for i, f := range files {
+		logger := log.With(logger, "file", f, "progress", fmt.Sprintf("%d/%d", i+1, n))
+		level.Debug(logger).Log("msg", "processing file")
+		self.filesScanned.Inc()
+		// check age
+		fileinfo, err := os.Stat(f)
+		if err != nil {
+			level.Warn(logger).Log("msg", "error stat()ing file", "err", err)
+			collector.SetFileStatus(f, time.Time{}, true)
+			self.filesFailed.Inc()
+			continue
+		}
+		// Old files are ignored and a specified external script may be run.
+		if time.Now().After(fileinfo.ModTime().Add(oldFilesAge)) {
+			level.Debug(logger).Log("msg", "old file")
+			collector.SetFileStatus(f, fileinfo.ModTime(), false)
+			self.oldFiles.Inc()
+			cmdString := strings.ReplaceAll(oldFilesExternalCmd, "{}", f)
+			cmd := exec.Command("sh", "-c", cmdString) /* #nosec G204 */ // External execution as designed.
+			level.Debug(logger).Log("msg", "running command", "cmd", cmdString)
+			cmdOut, err := cmd.Output()
+			if err != nil {
+				level.Warn(logger).Log("msg", "error running command", "cmd", cmdString, "err", err)
 			}
+			level.Debug(logger).Log("msg", "command output", "output", string(cmdOut))
+			continue
+		}
+		// Actual parsing.
+		mfs, openMetrics, err := parseMF(f)
+		if err != nil {
+			level.Warn(logger).Log("msg", "error parsing file", "err", err)
+			collector.SetFileStatus(f, fileinfo.ModTime(), true)
+			self.filesFailed.Inc()
+			continue
+		}
+		collector.SetFileStatus(f, fileinfo.ModTime(), false)
+		if openMetrics {
+			level.Debug(logger).Log("msg", "parsing as OpenMetrics")
+		}
 
-			// Let's collect a list of files to process.
-			var files []string
-			// For a dir, we process the contained files named "*.prom".
-			if fileinfo.IsDir() {
-				entries, err := os.ReadDir(filepath)
-				if err != nil {
-					break
-				}
-				for _, entry := range entries {
-					fi, err := entry.Info()
-					if err != nil {
-						continue
-					}
-					if fi.IsDir() {
-						continue // We do not do recursion.
-					}
-					name := fi.Name()
-					if fi.Mode().IsRegular() && strings.HasSuffix(name, ".prom") {
-						files = append(files, filepath+"/"+fi.Name())
-					}
+		// Handle parsing results.
+		cnt := 0
+		for name, mf := range mfs {
+			if seen, ok := metaSeen[name]; ok {
+				if seen.help != mf.GetHelp() || seen.typ != mf.GetType() {
+					inconsistentMeta = true
 				}
 			} else {
-				files = append(files, filepath)
+				metaSeen[name] = metaInfo{help: mf.GetHelp(), typ: mf.GetType()}
 			}
-			n := len(files)
-			log.Printf("Found %d files\n", n)
-
-			// Make the collector empty before parsing the files.
-			// This creates a possibility to have a totally/partially
-			// populated collector if a collect happens before
-			// we complete the parsing. Improvement area here.
-			collector.Clear()
-
-			// Parse the files.
-			for i, f := range files {
-				printIt := debugging || i < 5 || i >= n-5
-				if printIt {
-					log.Printf("%d/%d Processing file %s\n", i+1, n, f)
-				}
-				// check age
-				fileinfo, err := os.Stat(f)
-				if err != nil {
-					log.Printf("%d/%d Error stat()ing file %s\n", i+1, n, f)
-					continue
-				}
-				// Old files are ignored and a specified external script may be run.
-				if time.Now().After(fileinfo.ModTime().Add(*optOldFilesAge)) {
-					log.Printf("%d/%d Old file %s\n", i+1, n, f)
-					cmdString := strings.ReplaceAll(*optOldFilesExternalCmd, "{}", f)
-					cmd := exec.Command("sh", "-c", cmdString) /* #nosec G204 */ // External execution as designed.
-					log.Printf("%d/%d Running command %s\n", i+1, n, cmdString)
-					cmdOut, err := cmd.Output()
-					if err != nil {
-						log.Printf("%d/%d Error running command %s\n", i+1, n, cmdString)
-					}
-					fmt.Println("output:\n<<<\n" + string(cmdOut) + ">>>")
+
+			level.Debug(logger).Log("msg", "metric family", "name", name, "type", mf.GetType(), "help", mf.GetHelp())
+
+			var metric_value float64
+			var metric_type prometheus.ValueType
+			for _, m := range mf.GetMetric() {
+				// Fresh per series: m.GetLabel() differs sample to sample
+				// within a family, and metricEntry keeps this map by
+				// reference, so reusing one across iterations would let
+				// later series overwrite the labels of earlier ones.
+				labels := make(map[string]string, len(m.GetLabel()))
+				switch mf.GetType() {
+				case dto.MetricType_GAUGE:
+					metric_type = prometheus.GaugeValue
+					metric_value = m.GetGauge().GetValue()
+				case dto.MetricType_COUNTER:
+					metric_type = prometheus.CounterValue
+					metric_value = m.GetCounter().GetValue()
+				case dto.MetricType_UNTYPED:
+					metric_type = prometheus.UntypedValue
+					metric_value = m.GetUntyped().GetValue()
+				case dto.MetricType_SUMMARY, dto.MetricType_HISTOGRAM:
+					// Handled below once we have labels and a timestamp,
+					// since they carry more than a single float64 value.
+				default:
 					continue
 				}
-				// Actual parsing.
-				mfs, err := parseMF(f)
-				if err != nil {
-					log.Printf("%d/%d Error parsing file %s\n", i+1, n, f)
-					continue
+
+				// Handle the timestamp.
+				timestamp := m.GetTimestampMs()
+				if timestamp <= 0 { // We generate a timestamp if it is missing.
+					timestamp = time.Now().UTC().UnixNano() / 1000000
 				}
+				ts := time.Unix(0, timestamp*int64(time.Millisecond))
 
-				// Handle parsing results.
-				cnt := 0
-				for name, mf := range mfs {
-					labels := make(map[string]string)
-					if debugging {
-						log.Println("Metric Name: ", name)
-						log.Println("Metric Type: ", mf.GetType())
-						log.Println("Metric Help: ", mf.GetHelp())
-					}
-
-					var metric_value float64
-					var metric_type prometheus.ValueType
-				out:
-					for _, m := range mf.GetMetric() {
-						switch mf.GetType() {
-						case dto.MetricType_GAUGE:
-							metric_type = prometheus.GaugeValue
-							metric_value = m.GetGauge().GetValue()
-						case dto.MetricType_COUNTER:
-							metric_type = prometheus.CounterValue
-							metric_value = m.GetCounter().GetValue()
-						case dto.MetricType_SUMMARY:
-							break out
-						case dto.MetricType_UNTYPED:
-							metric_type = prometheus.UntypedValue
-							metric_value = m.GetUntyped().GetValue()
-						case dto.MetricType_HISTOGRAM:
-							break out
-						default:
-							break out
-						}
-
-						// Handle the timestamp.
-						timestamp := m.GetTimestampMs()
-						if debugging {
-							log.Println("  Metric Value: ", metric_value)
-							log.Println("  Timestamp: ", timestamp)
-						}
-						if timestamp <= 0 { // We generate a timestamp if it is missing.
-							timestamp = time.Now().UTC().UnixNano() / 1000000
-							if debugging {
-								log.Println("  Timestamp: ", timestamp, " (now)")
-							}
-						}
-
-						// Handle the labels.
-						for _, label := range m.GetLabel() {
-							if debugging {
-								log.Println("  Label_Name:  ", label.GetName())
-								log.Println("  Label_Value: ", label.GetValue())
-							}
-							labels[label.GetName()] = label.GetValue()
-						}
-
-						// Add the metric into the collector.
-						collector.Add(name, labels, metric_type, metric_value, time.Unix(0, timestamp*int64(time.Millisecond)), 0, mf.GetHelp())
-						cnt++
-
-						if debugging {
-							log.Println("-----------")
-						}
-					}
+				// Handle the labels.
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
 				}
-				if printIt {
-					log.Printf("%d/%d    found %d data points\n", i+1, n, cnt)
+
+				switch mf.GetType() {
+				case dto.MetricType_HISTOGRAM:
+					collector.AddHistogram(name, labels, histogramSampleFromProto(m.GetHistogram()), ts, 0, mf.GetHelp())
+				case dto.MetricType_SUMMARY:
+					collector.AddSummary(name, labels, summarySampleFromProto(m.GetSummary()), ts, 0, mf.GetHelp())
+				default:
+					// Add the metric into the collector.
+					collector.Add(name, labels, metric_type, metric_value, ts, 0, mf.GetHelp())
 				}
+				cnt++
 			}
-			time.Sleep(*optScanInterval)
-
 		}
+		level.Debug(logger).Log("msg", "found data points", "count", cnt)
+	}
+	collector.SetScanInconsistent(inconsistentMeta)
+	collector.EndScan()
+	if pusher != nil {
+		if err := pusher.Push(); err != nil {
+			level.Warn(logger).Log("msg", "error pushing to Pushgateway", "err", err)
+		}
+	}
+	self.scanDuration.Observe(time.Since(scanStart).Seconds())
+	self.lastScanTimestamp.Set(float64(time.Now().Unix()))
+}
 
-	}()
+// Main function here.
+func main() {
 
-	// Register ourselves.
+	// Handle passed or default options.
+	optListenPort := flag.Int("l", 9014, "listen port")
+	optPromPath := flag.String("p", ".", "comma-separated list of glob patterns, prom files, or dirs of *.prom/*.om files")
+	optRecursive := flag.Bool("r", false, "recurse into subdirectories of -p entries that are directories")
+	optScanInterval := flag.Duration("i", 30*time.Second, "scan interval")
+	optMemoryMaxAge := flag.Duration("m", 25*time.Hour, "max age of in memory metrics")
+	optOldFilesAge := flag.Duration("o", 6*time.Hour, "min age of files considered old")
+	optOldFilesExternalCmd := flag.String("x", "ls -l {}", "external command executed on old files")
+	optPushURL := flag.String("push", "", "Pushgateway URL to push metrics to after every scan cycle, in addition to serving /metrics")
+	optPushJob := flag.String("push-job", "textfile_exporter", "job label used when pushing to the Pushgateway")
+	optPushGrouping := flag.String("push-grouping", "", "comma-separated key=value grouping labels used when pushing to the Pushgateway")
+	optPushFormat := flag.String("push-format", "text", "wire format used when pushing: text, protobuf, or openmetrics")
+	optLogLevel := flag.String("log.level", "info", "log level: debug, info, warn, or error")
+	optLogFormat := flag.String("log.format", "logfmt", "log output format: logfmt or json")
+	optOnce := flag.Bool("once", false, "scan and push once then exit, instead of running as a daemon; for invoking as a short-lived cron job alongside -push")
+
+	flag.Usage = func() {
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	// Set up the runtime-adjustable logger. Its level can be raised or
+	// lowered later via a SIGHUP or a request to /debug/level, replacing
+	// the old filesystem-based "touch debug_tfe" toggle.
+	ls, err := newLogState(*optLogFormat, *optLogLevel)
+	fatal(log.NewLogfmtLogger(os.Stderr), err)
+	ls.WatchSIGHUP()
+
+	// Create our collector.
+	collector := newTimeAwareCollector(*optMemoryMaxAge)
+	self := newSelfMetrics()
+
+	// Register ourselves. Built up front (rather than after the scan loop
+	// below) since the optional pusher needs to gather from it too.
 	r := prometheus.NewRegistry()
 	r.MustRegister(collector)
+	r.MustRegister(self)
+
+	pusher, err := newPusher(ls.L(), *optPushURL, *optPushJob, *optPushGrouping, *optPushFormat, r)
+	fatal(ls.L(), err)
+
+	// -once is for running as a short-lived cron job: do a single
+	// scan-and-push, then exit instead of binding a port and looping.
+	if *optOnce {
+		runScan(ls.L(), collector, self, pusher, *optPromPath, *optRecursive, *optOldFilesAge, *optOldFilesExternalCmd)
+		return
+	}
+
+	// Start a background job to constantly watch for files and parse them.
+	go func() {
+		level.Info(ls.L()).Log("msg", "Textfile Exporter started")
+		for { // for ever
+			runScan(ls.L(), collector, self, pusher, *optPromPath, *optRecursive, *optOldFilesAge, *optOldFilesExternalCmd)
+			time.Sleep(*optScanInterval)
+		}
+	}()
+
 	handler := promhttp.HandlerFor(r, promhttp.HandlerOpts{})
 	http.Handle("/metrics", handler)
 	http.HandleFunc("/alive", aliveAnswer)
+	http.HandleFunc("/debug/level", ls.ServeDebugLevel)
 
 	// Configure the http server and start it.
 	s := &http.Server{
@@ -257,13 +448,12 @@ func main() {
 		WriteTimeout:   30 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	log.Fatal(s.ListenAndServe())
+	fatal(ls.L(), s.ListenAndServe())
 }
 
 // This can be called by liveness probes, a lot better than
 // invoking the /metrics endpoint and generate output that
 // will be ignored.
 func aliveAnswer(w http.ResponseWriter, req *http.Request) {
-	log.Println("confirming i'm alive")
 	fmt.Fprintf(w, "i'm alive\n")
 }
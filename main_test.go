@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("# HELP x x\n# TYPE x gauge\nx 1\n"), 0644); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+// TestExpandPatternsCrossRootCollision covers the scenario chunk0-3 added
+// support for: several directories, reached via a comma-separated pattern
+// list, that each contain a same-named textfile. They must all show up,
+// keyed by their distinct absolute paths, rather than being deduplicated
+// into one.
+func TestExpandPatternsCrossRootCollision(t *testing.T) {
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+	writeFile(t, filepath.Join(dirA, "metrics.prom"))
+	writeFile(t, filepath.Join(dirB, "metrics.prom"))
+	writeFile(t, filepath.Join(dirA, "notes.txt")) // not a watched extension
+
+	patterns := dirA + "," + dirB
+	got := expandPatterns(log.NewNopLogger(), patterns, false)
+	sort.Strings(got)
+
+	want := []string{filepath.Join(dirA, "metrics.prom"), filepath.Join(dirB, "metrics.prom")}
+	sort.Strings(want)
+
+	if len(got) != len(want) {
+		t.Fatalf("expandPatterns() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expandPatterns()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+// TestExpandPatternsRecursive covers the -r flag: nested textfiles are only
+// picked up when recursion is requested.
+func TestExpandPatternsRecursive(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "nested")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("mkdir %s: %v", sub, err)
+	}
+	writeFile(t, filepath.Join(root, "top.prom"))
+	writeFile(t, filepath.Join(sub, "deep.prom"))
+
+	flat := expandPatterns(log.NewNopLogger(), root, false)
+	if len(flat) != 1 {
+		t.Fatalf("non-recursive expandPatterns() = %v, want exactly the top-level file", flat)
+	}
+
+	recursive := expandPatterns(log.NewNopLogger(), root, true)
+	if len(recursive) != 2 {
+		t.Fatalf("recursive expandPatterns() = %v, want both files", recursive)
+	}
+}
+
+// TestExpandPatternsDirectlyNamedFile covers passing -p a single, directly
+// named file that doesn't end in .prom/.om: it must still be scanned,
+// matching the pre-chunk0-3 behavior of accepting any explicitly named path.
+func TestExpandPatternsDirectlyNamedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.txt")
+	writeFile(t, path)
+
+	got := expandPatterns(log.NewNopLogger(), path, false)
+	if len(got) != 1 || got[0] != path {
+		t.Fatalf("expandPatterns(%q) = %v, want [%s]", path, got, path)
+	}
+}
+
+// TestRunScanMultiSeriesFamily round-trips a family with more than one
+// labeled series through runScan and Collect, guarding against each series
+// sharing one mutable labels map (which would make every series in the
+// family read back with the last one's label values).
+func TestRunScanMultiSeriesFamily(t *testing.T) {
+	dir := t.TempDir()
+	contents := "# HELP req request count\n# TYPE req counter\n" +
+		"req{method=\"GET\",code=\"200\"} 1\n" +
+		"req{method=\"POST\",code=\"404\"} 2\n"
+	if err := os.WriteFile(filepath.Join(dir, "metrics.prom"), []byte(contents), 0644); err != nil {
+		t.Fatalf("writing metrics.prom: %v", err)
+	}
+
+	collector := newTimeAwareCollector(time.Hour)
+	self := newSelfMetrics()
+	runScan(log.NewNopLogger(), collector, self, nil, dir, false, 6*time.Hour, "true")
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(collector)
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error: %v", err)
+	}
+
+	var req *dto.MetricFamily
+	for _, mf := range mfs {
+		if mf.GetName() == "req" {
+			req = mf
+		}
+	}
+	if req == nil {
+		t.Fatalf("family %q not found in %v", "req", mfs)
+	}
+	if len(req.GetMetric()) != 2 {
+		t.Fatalf("got %d series for %q, want 2", len(req.GetMetric()), "req")
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range req.GetMetric() {
+		labels := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		key := labels["method"] + "/" + labels["code"]
+		seen[key] = true
+	}
+	if !seen["GET/200"] || !seen["POST/404"] {
+		t.Fatalf("series label sets = %v, want both GET/200 and POST/404 (shared-map aliasing bug)", seen)
+	}
+}
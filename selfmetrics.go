@@ -0,0 +1,62 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// selfMetrics tracks the exporter's own health, registered on the same
+// registry as timeAwareCollector so they show up next to the textfile
+// metrics on /metrics.
+type selfMetrics struct {
+	filesScanned      prometheus.Counter
+	filesFailed       prometheus.Counter
+	oldFiles          prometheus.Counter
+	scanDuration      prometheus.Histogram
+	lastScanTimestamp prometheus.Gauge
+}
+
+// newSelfMetrics builds the self-metrics with their descriptors. It doesn't
+// register them anywhere; the caller does that via r.MustRegister, since
+// selfMetrics implements prometheus.Collector through its embedded
+// instruments being collected individually in Collect.
+func newSelfMetrics() *selfMetrics {
+	return &selfMetrics{
+		filesScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "textfile_exporter_files_scanned_total",
+			Help: "Total number of textfiles scanned.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "textfile_exporter_files_failed_total",
+			Help: "Total number of textfiles that failed to stat or parse.",
+		}),
+		oldFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "textfile_exporter_old_files_total",
+			Help: "Total number of textfiles skipped for being older than -o.",
+		}),
+		scanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "textfile_exporter_scan_duration_seconds",
+			Help:    "Duration of each scan cycle.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		lastScanTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "textfile_exporter_last_scan_timestamp_seconds",
+			Help: "Unix timestamp of the end of the last scan cycle.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *selfMetrics) Describe(ch chan<- *prometheus.Desc) {
+	s.filesScanned.Describe(ch)
+	s.filesFailed.Describe(ch)
+	s.oldFiles.Describe(ch)
+	s.scanDuration.Describe(ch)
+	s.lastScanTimestamp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *selfMetrics) Collect(ch chan<- prometheus.Metric) {
+	s.filesScanned.Collect(ch)
+	s.filesFailed.Collect(ch)
+	s.oldFiles.Collect(ch)
+	s.scanDuration.Collect(ch)
+	s.lastScanTimestamp.Collect(ch)
+}